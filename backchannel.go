@@ -0,0 +1,128 @@
+package gin_oidc
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/coreos/go-oidc"
+	"github.com/gin-gonic/gin"
+)
+
+// backchannelLogoutEvent is the "events" claim member that OIDC Back-Channel Logout 1.0
+// requires on a logout token.
+const backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// SessionIndex maps the "sid" (session id) claim from an ID token to whatever locates
+// the matching local session in your session store - a Redis key, a DB row id, etc.
+// gin-contrib/sessions has no "delete session by id" primitive of its own, since a
+// session is only ever looked up via the cookie on its own request, so Invalidate is
+// expected to reach into the real store directly. callbackHandler populates the index
+// via Put on every successful login whose ID token carries a "sid" claim;
+// BackchannelLogoutHandler calls Invalidate when it
+// verifies a logout_token for that sid.
+type SessionIndex interface {
+	Put(sid string, sessionKey string) error
+	Invalidate(sid string) error
+}
+
+// MemorySessionIndex is a process-local SessionIndex, useful for trying Back-Channel
+// Logout out or for a single-instance deployment that keeps sessions in memory. Its
+// Invalidate only forgets the sid->sessionKey mapping - plug in a SessionIndex backed
+// by your real session store (Redis, a database) if Invalidate needs to actually end
+// the session.
+type MemorySessionIndex struct {
+	mu    sync.Mutex
+	bySid map[string]string
+}
+
+func NewMemorySessionIndex() *MemorySessionIndex {
+	return &MemorySessionIndex{bySid: make(map[string]string)}
+}
+
+func (idx *MemorySessionIndex) Put(sid string, sessionKey string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.bySid[sid] = sessionKey
+	return nil
+}
+
+func (idx *MemorySessionIndex) Invalidate(sid string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	delete(idx.bySid, sid)
+	return nil
+}
+
+// BackchannelLogoutHandler implements the Relying Party side of OIDC Back-Channel
+// Logout 1.0: it accepts a POST with a logout_token form value, verifies it with a
+// verifier configured for logout tokens (same as the ID token verifier, but with
+// expiry checking disabled - "exp" is optional on a logout token per spec), checks the
+// logout-token-specific requirements that verifier doesn't already cover (the events
+// claim, the presence of iat, the absence of nonce, and the presence of sid or sub),
+// and invalidates the matching session via i.SessionIndex. Sessions are looked up by
+// sid only: a logout token that carries sub but no sid is accepted with 200 and
+// invalidates nothing. Register it, unprotected, at
+// whatever path your provider is configured to call - there's no user session or
+// cookie on this request, so it can't go through protectMiddleware.
+func BackchannelLogoutHandler(i InitParams, verifier *oidc.IDTokenVerifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logoutToken := c.PostForm("logout_token")
+		if logoutToken == "" {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		idToken, err := verifier.Verify(c.Request.Context(), logoutToken)
+		if err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		if idToken.IssuedAt.IsZero() {
+			// "iat" is REQUIRED on a logout token; the verifier treats it as
+			// informational only, so enforce its presence here.
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		if idToken.Nonce != "" {
+			// A logout token MUST NOT contain a nonce - its presence suggests this is
+			// an ID token being replayed against this endpoint, not a real logout token.
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		var claims struct {
+			Events map[string]interface{} `json:"events"`
+			Sid    string                 `json:"sid"`
+		}
+		if err := idToken.Claims(&claims); err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		if _, ok := claims.Events[backchannelLogoutEvent]; !ok {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		if claims.Sid == "" && idToken.Subject == "" {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		if claims.Sid != "" && i.SessionIndex != nil {
+			if err := i.SessionIndex.Invalidate(claims.Sid); err != nil {
+				if handleError(c, i, err, "failed to invalidate session for backchannel logout") {
+					return
+				}
+			}
+		}
+
+		if i.OnLogout != nil {
+			i.OnLogout(c.Request.Context(), idToken.Subject)
+		}
+
+		c.Status(http.StatusOK)
+	}
+}
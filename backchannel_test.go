@@ -0,0 +1,157 @@
+package gin_oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/gin-gonic/gin"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+type recordingSessionIndex struct {
+	invalidated []string
+}
+
+func (r *recordingSessionIndex) Put(sid, sessionKey string) error { return nil }
+
+func (r *recordingSessionIndex) Invalidate(sid string) error {
+	r.invalidated = append(r.invalidated, sid)
+	return nil
+}
+
+// newTestLogoutVerifier builds a verifier the way initVerifierAndConfig builds
+// logoutTokenVerifier - SkipExpiryCheck enabled, backed by a real RemoteKeySet - so the
+// test exercises the same signature/issuer/audience checks BackchannelLogoutHandler
+// relies on in production.
+func newTestLogoutVerifier(t *testing.T, issuer, clientID string) (*oidc.IDTokenVerifier, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	jwks := jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jwks)
+	}))
+	t.Cleanup(server.Close)
+	keySet := oidc.NewRemoteKeySet(context.Background(), server.URL)
+	verifier := oidc.NewVerifier(issuer, keySet, &oidc.Config{ClientID: clientID, SkipExpiryCheck: true})
+	return verifier, key
+}
+
+func signLogoutToken(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	t.Helper()
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		&jose.SignerOptions{ExtraHeaders: map[jose.HeaderKey]interface{}{"kid": "test"}},
+	)
+	if err != nil {
+		t.Fatalf("new signer: %v", err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshal claims: %v", err)
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	compact, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatalf("compact serialize: %v", err)
+	}
+	return compact
+}
+
+func TestBackchannelLogoutHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const issuer = "https://issuer.example.com"
+	const clientID = "test-client"
+	verifier, key := newTestLogoutVerifier(t, issuer, clientID)
+
+	baseClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":    issuer,
+			"aud":    clientID,
+			"sub":    "user-1",
+			"sid":    "session-1",
+			"iat":    time.Now().Unix(),
+			"events": map[string]interface{}{backchannelLogoutEvent: map[string]interface{}{}},
+		}
+	}
+
+	tests := []struct {
+		name            string
+		mutate          func(claims map[string]interface{})
+		wantStatus      int
+		wantInvalidated bool
+	}{
+		{
+			name:            "valid logout token without exp is accepted",
+			mutate:          func(claims map[string]interface{}) {},
+			wantStatus:      http.StatusOK,
+			wantInvalidated: true,
+		},
+		{
+			name:       "missing iat is rejected",
+			mutate:     func(claims map[string]interface{}) { delete(claims, "iat") },
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "nonce present is rejected",
+			mutate:     func(claims map[string]interface{}) { claims["nonce"] = "n-123" },
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "missing events is rejected",
+			mutate:     func(claims map[string]interface{}) { delete(claims, "events") },
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "missing sid and sub is rejected",
+			mutate: func(claims map[string]interface{}) {
+				delete(claims, "sid")
+				delete(claims, "sub")
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := baseClaims()
+			tc.mutate(claims)
+			token := signLogoutToken(t, key, claims)
+
+			sessionIndex := &recordingSessionIndex{}
+			handler := BackchannelLogoutHandler(InitParams{SessionIndex: sessionIndex}, verifier)
+
+			form := url.Values{"logout_token": []string{token}}
+			req := httptest.NewRequest(http.MethodPost, "/backchannel-logout", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = req
+
+			handler(c)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tc.wantStatus)
+			}
+			if tc.wantInvalidated && len(sessionIndex.invalidated) != 1 {
+				t.Fatalf("expected session to be invalidated, got %v", sessionIndex.invalidated)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package gin_oidc
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// claimsContextKey is where protectMiddleware stashes the parsed ID token claims, so
+// downstream handlers (and RequireClaims) don't have to re-parse the JSON string kept
+// in the session on every request.
+const claimsContextKey = "oidc.claims"
+
+// ClaimMatcher is a predicate over the authenticated user's ID token claims, used with
+// RequireClaims to build authorization rules on top of what protectMiddleware already
+// enforces ("is authenticated").
+type ClaimMatcher func(claims map[string]interface{}) bool
+
+// RequireClaims returns middleware that responds 403 Forbidden unless every matcher
+// passes against the claims protectMiddleware parsed for this request. Register it
+// after protectMiddleware on routes that need finer-grained authorization, e.g.:
+//
+//	admin.Use(oidcMiddleware.AuthHandler, gin_oidc.RequireClaims(gin_oidc.RequireScope("admin")))
+func RequireClaims(matchers ...ClaimMatcher) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := ClaimsFromContext(c)
+		if !ok {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		for _, matcher := range matchers {
+			if !matcher(claims) {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// ClaimsFromContext returns the claims stashed by protectMiddleware for the current
+// request, if any.
+func ClaimsFromContext(c *gin.Context) (map[string]interface{}, bool) {
+	value, ok := c.Get(claimsContextKey)
+	if !ok {
+		return nil, false
+	}
+	claims, ok := value.(map[string]interface{})
+	return claims, ok
+}
+
+// RequireScope matches when the space-separated OAuth2 "scope" claim contains scope.
+func RequireScope(scope string) ClaimMatcher {
+	return func(claims map[string]interface{}) bool {
+		raw, ok := claims["scope"].(string)
+		if !ok {
+			return false
+		}
+		for _, s := range strings.Fields(raw) {
+			if s == scope {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// RequireClaimEquals matches when the claim at dotPath equals value.
+func RequireClaimEquals(dotPath string, value interface{}) ClaimMatcher {
+	return func(claims map[string]interface{}) bool {
+		v, ok := claimAtPath(claims, dotPath)
+		return ok && v == value
+	}
+}
+
+// RequireClaimContains matches when the claim at dotPath is a JSON array containing
+// value, e.g. RequireClaimContains("realm_access.roles", "editor") for Keycloak-style
+// nested role claims.
+func RequireClaimContains(dotPath string, value interface{}) ClaimMatcher {
+	return func(claims map[string]interface{}) bool {
+		v, ok := claimAtPath(claims, dotPath)
+		if !ok {
+			return false
+		}
+		items, ok := v.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, item := range items {
+			if item == value {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// RequireAudience matches when aud is present in the "aud" claim, which per OIDC may be
+// either a single string or a JSON array of strings.
+func RequireAudience(aud string) ClaimMatcher {
+	return func(claims map[string]interface{}) bool {
+		switch v := claims["aud"].(type) {
+		case string:
+			return v == aud
+		case []interface{}:
+			for _, item := range v {
+				if s, ok := item.(string); ok && s == aud {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// claimAtPath traverses claims following a dot-separated path of nested object keys,
+// e.g. "realm_access.roles" for Keycloak-style claims.
+func claimAtPath(claims map[string]interface{}, dotPath string) (interface{}, bool) {
+	var current interface{} = claims
+	for _, key := range strings.Split(dotPath, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = m[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
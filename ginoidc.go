@@ -4,60 +4,93 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"log"
-	"math/rand"
+	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
-	"time"
 
 	"github.com/coreos/go-oidc"
 	sessions "github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/securecookie"
 	"golang.org/x/oauth2"
 )
 
 type InitParams struct {
-	ClientId      string          //id from the authorization service (OIDC provider)
-	ClientSecret  string          //secret from the authorization service (OIDC provider)
-	ClientName    string          // a name for the Client, becomes a base path
-	Issuer        url.URL         //the URL identifier for the authorization service. for example: "https://accounts.google.com" - try adding "/.well-known/openid-configuration" to the path to make sure it's correct
-	ClientUrl     url.URL         //your website's/service's URL for example: "http://localhost:8081/" or "https://mydomain.com/
-	Scopes        []string        //OAuth scopes. If you're unsure go with: []string{oidc.ScopeOpenID, "profile", "email"}
-	ErrorHandler  gin.HandlerFunc //errors handler. for example: func(c *gin.Context) {c.String(http.StatusBadRequest, "ERROR...")}
-	CallbackPath  string
-	LogoutUrl     *url.URL // the logout URL at the Issuer to connect to for ending the session.  Is set automatically.
-	PostLogoutUrl url.URL  //user will be redirected to this URL after he logs out (i.e. accesses the '/logout' endpoint added in 'Init()')
+	ClientId            string          //id from the authorization service (OIDC provider)
+	ClientSecret        string          //secret from the authorization service (OIDC provider)
+	ClientName          string          // a name for the Client, becomes a base path
+	Issuer              url.URL         //the URL identifier for the authorization service. for example: "https://accounts.google.com" - try adding "/.well-known/openid-configuration" to the path to make sure it's correct
+	ClientUrl           url.URL         //your website's/service's URL for example: "http://localhost:8081/" or "https://mydomain.com/
+	Scopes              []string        //OAuth scopes. If you're unsure go with: []string{oidc.ScopeOpenID, "profile", "email"}
+	ErrorHandler        gin.HandlerFunc //errors handler. for example: func(c *gin.Context) {c.String(http.StatusBadRequest, "ERROR...")}
+	CallbackPath        string
+	LogoutUrl           *url.URL                                                 // the logout URL at the Issuer to connect to for ending the session.  Is set automatically.
+	PostLogoutUrl       url.URL                                                  //user will be redirected to this URL after he logs out (i.e. accesses the '/logout' endpoint added in 'Init()')
+	TokenStore          TokenStore                                               //optional. persists refresh tokens server-side instead of in the (possibly cookie-backed) session. Defaults to keeping the refresh token in the session.
+	UsePKCE             *bool                                                    //whether to use PKCE on the Authorization Code flow. Defaults to true (nil); set to a pointer to false to opt out for confidential clients that don't need it.
+	StateStore          StateStore                                               //optional. persists the state/nonce/PKCE-verifier/original-URL used during the redirect round-trip. Defaults to a CookieStateStore with process-local keys.
+	LogoutMode          LogoutMode                                               //how logoutHandler ends a session. Defaults to RPInitiated.
+	LogoutParamsBuilder func(i InitParams, rawIDToken string) url.Values         //optional. builds the query params for the RPInitiated front-channel redirect. Defaults to DefaultLogoutParamsBuilder.
+	SessionIndex        SessionIndex                                             //optional. records sid->session mappings on login so BackchannelLogoutHandler can invalidate the right session. Defaults to a MemorySessionIndex.
+	Logger              Logger                                                   //optional. receives operational and security-relevant log lines. Defaults to the standard "log" package.
+	OnLogin             func(ctx context.Context, claims map[string]interface{}) //optional. called after a successful login, with the ID token claims.
+	OnLogout            func(ctx context.Context, sub string)                    //optional. called after a session ends, whether via logoutHandler or BackchannelLogoutHandler.
+	OnTokenRefresh      func(ctx context.Context, claims map[string]interface{}) //optional. called after protectMiddleware silently refreshes an expired ID token.
+	OnError             func(ctx context.Context, stage string, err error)       //optional. called alongside every error ErrorHandler handles, with the stage it happened in.
 }
 
 type OidcMiddleware struct {
 	InitParams
-	Verifier        *oidc.IDTokenVerifier
-	Config          *oauth2.Config
-	AuthHandler     gin.HandlerFunc
-	LogoutHandler   gin.HandlerFunc
-	CallbackHandler gin.HandlerFunc
+	Verifier                 *oidc.IDTokenVerifier
+	Config                   *oauth2.Config
+	AuthHandler              gin.HandlerFunc
+	LogoutHandler            gin.HandlerFunc
+	CallbackHandler          gin.HandlerFunc
+	BackchannelLogoutHandler gin.HandlerFunc
 }
 
-func New(i InitParams) *OidcMiddleware {
-	verifier, config := initVerifierAndConfig(&i)
+// New builds an OidcMiddleware, discovering the provider's configuration from
+// i.Issuer. It returns an error instead of killing the process if discovery fails, so
+// callers can retry (e.g. with backoff) if the IdP is temporarily unreachable at boot.
+func New(i InitParams) (*OidcMiddleware, error) {
+	if i.StateStore == nil {
+		// Process-local keys: fine for a single instance, but a deployment running
+		// multiple instances behind a load balancer should supply its own StateStore
+		// (or at least its own CookieStateStore keys) so a redirect handled by one
+		// instance can be completed by another.
+		i.StateStore = NewCookieStateStore(securecookie.GenerateRandomKey(64), securecookie.GenerateRandomKey(32))
+	}
+	if i.SessionIndex == nil {
+		i.SessionIndex = NewMemorySessionIndex()
+	}
+	verifier, logoutTokenVerifier, config, err := initVerifierAndConfig(&i)
+	if err != nil {
+		return nil, err
+	}
 	authHandler := protectMiddleware(i, verifier, config)
 	logoutHandler := logoutHandler(i)
 	callbackHandler := callbackHandler(i, verifier, config)
+	backchannelLogoutHandler := BackchannelLogoutHandler(i, logoutTokenVerifier)
 
-	return &OidcMiddleware{i, verifier, config, authHandler, logoutHandler, callbackHandler}
+	return &OidcMiddleware{i, verifier, config, authHandler, logoutHandler, callbackHandler, backchannelLogoutHandler}, nil
 }
 
-func initVerifierAndConfig(i *InitParams) (*oidc.IDTokenVerifier, *oauth2.Config) {
+func initVerifierAndConfig(i *InitParams) (*oidc.IDTokenVerifier, *oidc.IDTokenVerifier, *oauth2.Config, error) {
 	providerCtx := context.Background()
 	provider, err := oidc.NewProvider(providerCtx, i.Issuer.String())
 	if err != nil {
-		log.Fatalf("Failed to init OIDC provider. Error: %v \n", err.Error())
+		return nil, nil, nil, fmt.Errorf("failed to init OIDC provider: %w", err)
 	}
 	oidcConfig := &oidc.Config{
 		ClientID: i.ClientId,
 	}
 	verifier := provider.Verifier(oidcConfig)
+	// Logout tokens are signed the same way as ID tokens, but OIDC Back-Channel Logout
+	// 1.0 makes "exp" optional, so this verifier can't enforce expiry the way the
+	// regular ID token verifier does - BackchannelLogoutHandler checks the
+	// logout-token-specific requirements (events, iat, nonce, sid/sub) itself.
+	logoutTokenVerifier := provider.Verifier(&oidc.Config{ClientID: i.ClientId, SkipExpiryCheck: true})
 	endpoint := provider.Endpoint()
 	i.ClientUrl.Path = i.CallbackPath
 	config := &oauth2.Config{
@@ -71,32 +104,34 @@ func initVerifierAndConfig(i *InitParams) (*oidc.IDTokenVerifier, *oauth2.Config
 	issuerMetadata := make(map[string]interface{})
 	err = provider.Claims(&issuerMetadata)
 	if err != nil {
-		log.Fatalf("Failed to parse Issuer (%v) discovery endpoint.  Error: %v\n", i.Issuer, err)
+		return nil, nil, nil, fmt.Errorf("failed to parse issuer (%v) discovery endpoint: %w", i.Issuer, err)
 	}
 	if logout, ok := issuerMetadata["end_session_endpoint"]; ok {
 		logoutUrl, err := url.Parse(logout.(string))
 		if err != nil {
-			log.Fatalf("Funny business getting end_session_endpoint for Issuer %v. Got URL: %v Error: %v\n", i.Issuer, logout, err)
+			return nil, nil, nil, fmt.Errorf("failed to parse end_session_endpoint for issuer %v (got %v): %w", i.Issuer, logout, err)
 		}
 		i.LogoutUrl = logoutUrl
 	} else {
 		logoutUrl, err := url.Parse(strings.TrimSuffix(i.Issuer.String(), "/") + "protocol/openid-connect/logout")
 		if err != nil {
-			log.Fatalf("Could not set default logout for Issuer %v. Error: %v\n", i.Issuer, err)
+			return nil, nil, nil, fmt.Errorf("failed to set default logout for issuer %v: %w", i.Issuer, err)
 		}
 		i.LogoutUrl = logoutUrl
 	}
-	return verifier, config
+	return verifier, logoutTokenVerifier, config, nil
 }
 
 func logoutHandler(i InitParams) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		serverSession := sessions.Default(c)
 
-		rawIDToken := serverSession.Get("oidcIDToken")
-		var skipProviderLogout = true
-		if rawIDToken != nil && rawIDToken.(string) != "" {
-			skipProviderLogout = false
+		rawIDToken, _ := serverSession.Get("oidcIDToken").(string)
+
+		if i.TokenStore != nil {
+			if key, ok := serverSession.Get("oidcTokenKey").(string); ok && key != "" {
+				i.TokenStore.DeleteToken(key)
+			}
 		}
 
 		serverSession.Set("oidcAuthorized", false)
@@ -104,19 +139,27 @@ func logoutHandler(i InitParams) func(c *gin.Context) {
 		serverSession.Set("oidcState", nil)
 		serverSession.Set("oidcOriginalRequestUrl", nil)
 		serverSession.Set("oidcIDToken", nil)
+		serverSession.Set("oidcRefreshToken", nil)
+		serverSession.Set("oidcTokenKey", nil)
+		serverSession.Set("oidcSessionKey", nil)
 		serverSession.Save()
 
-		if skipProviderLogout {
+		if i.OnLogout != nil {
+			i.OnLogout(c.Request.Context(), unverifiedSubClaim(rawIDToken))
+		}
+
+		if i.LogoutMode != RPInitiated || rawIDToken == "" {
 			c.Redirect(http.StatusFound, i.PostLogoutUrl.String())
 			return
 		}
 
-		logoutUrl := *i.LogoutUrl
-		//XXX This may need to be different depending on "provider" (i.e. Okta vs. Auth0)
+		paramsBuilder := i.LogoutParamsBuilder
+		if paramsBuilder == nil {
+			paramsBuilder = DefaultLogoutParamsBuilder
+		}
 
-		logoutUrl.RawQuery = (url.Values{
-			"post_logout_redirect_uri": []string{i.PostLogoutUrl.String()},
-			"id_token_hint":            []string{rawIDToken.(string)}}).Encode()
+		logoutUrl := *i.LogoutUrl
+		logoutUrl.RawQuery = paramsBuilder(i, rawIDToken).Encode()
 		c.Redirect(http.StatusFound, logoutUrl.String())
 	}
 }
@@ -126,16 +169,22 @@ func callbackHandler(i InitParams, verifier *oidc.IDTokenVerifier, config *oauth
 		ctx := c.Request.Context()
 		serverSession := sessions.Default(c)
 
-		state, ok := (serverSession.Get("oidcState")).(string)
-		if handleOk(c, i, ok, "failed to parse state") {
+		authState, err := i.StateStore.Load(c)
+		if handleError(c, i, err, "failed to load auth state") {
 			return
 		}
+		i.StateStore.Clear(c)
 
-		if handleOk(c, i, c.Query("state") == state, "get 'state' param didn't match local 'state' value") {
+		if handleOk(c, i, authState.State != "" && c.Query("state") == authState.State, "get 'state' param didn't match stored 'state' value") {
 			return
 		}
 
-		oauth2Token, err := config.Exchange(ctx, c.Query("code"))
+		var exchangeOptions []oauth2.AuthCodeOption
+		if authState.CodeVerifier != "" {
+			exchangeOptions = append(exchangeOptions, oauth2.SetAuthURLParam("code_verifier", authState.CodeVerifier))
+		}
+
+		oauth2Token, err := config.Exchange(ctx, c.Query("code"), exchangeOptions...)
 		if handleError(c, i, err, "failed to exchange token") {
 			return
 		}
@@ -150,6 +199,10 @@ func callbackHandler(i InitParams, verifier *oidc.IDTokenVerifier, config *oauth
 			return
 		}
 
+		if handleOk(c, i, idToken.Nonce == authState.Nonce, "id token nonce didn't match stored nonce value") {
+			return
+		}
+
 		var claims map[string]interface{}
 		err = idToken.Claims(&claims)
 		if handleError(c, i, err, "failed to parse id token") {
@@ -161,29 +214,33 @@ func callbackHandler(i InitParams, verifier *oidc.IDTokenVerifier, config *oauth
 			return
 		}
 
-		originalRequestUrl, ok := (serverSession.Get("oidcOriginalRequestUrl")).(string)
-		if handleOk(c, i, ok, "failed to parse originalRequestUrl") {
-			return
-		}
-
 		serverSession.Set("oidcAuthorized", true)
-		serverSession.Set("oidcState", nil)
-		serverSession.Set("oidcOriginalRequestUrl", nil)
 		serverSession.Set("oidcClaims", string(claimsJson))
 		serverSession.Set("oidcIDToken", rawIDToken)
 
-		// if we were using cookies for session state then we don't want to store
-		// these with the browser.  Adding them will also make the whole thing way
-		// to big and we'll likely see errors.
-		// serverSession.Set("oidcAccessToken", oauth2Token.AccessToken)
-		// serverSession.Set("oidcRefreshToken", oauth2Token.RefreshToken)
+		if sid, ok := claims["sid"].(string); ok && sid != "" {
+			sessionKey := RandomString(32)
+			serverSession.Set("oidcSessionKey", sessionKey)
+			if err := i.SessionIndex.Put(sid, sessionKey); handleError(c, i, err, "failed to record session index") {
+				return
+			}
+		}
+
+		err = saveRefreshToken(i, serverSession, oauth2Token)
+		if handleError(c, i, err, "failed to persist refresh token") {
+			return
+		}
 
 		err = serverSession.Save()
 		if handleError(c, i, err, "failed save sessions.") {
 			return
 		}
 
-		c.Redirect(http.StatusFound, originalRequestUrl)
+		if i.OnLogin != nil {
+			i.OnLogin(ctx, claims)
+		}
+
+		c.Redirect(http.StatusFound, authState.OriginalRequestUrl)
 	}
 }
 
@@ -198,32 +255,130 @@ func protectMiddleware(i InitParams, verifier *oidc.IDTokenVerifier, config *oau
 			if rawIDToken != nil && rawIDToken.(string) != "" {
 				ctx := c.Request.Context()
 				_, err := verifier.Verify(ctx, rawIDToken.(string))
-				if handleError(c, i, err, "failed to verify id token") {
+				if err != nil {
+					if !refreshSession(c, i, verifier, config, serverSession) {
+						redirectToAuthorization(c, i, config, serverSession)
+						return
+					}
+				}
+			}
+
+			if claimsJson, ok := serverSession.Get("oidcClaims").(string); ok && claimsJson != "" {
+				var claims map[string]interface{}
+				if handleError(c, i, json.Unmarshal([]byte(claimsJson), &claims), "failed to parse stored claims") {
 					return
 				}
+				c.Set(claimsContextKey, claims)
 			}
+
 			c.Next()
 			return
 		}
-		state := RandomString(16)
-		serverSession.Set("oidcAuthorized", false)
-		serverSession.Set("oidcState", state)
-		serverSession.Set("oidcOriginalRequestUrl", c.Request.URL.String())
-		serverSession.Set("oidcIDToken", nil)
-		err := serverSession.Save()
-		if err != nil {
-			log.Fatal("failed save sessions. error: " + err.Error()) // todo handle more gracefully
+		redirectToAuthorization(c, i, config, serverSession)
+	}
+
+}
+
+// refreshSession attempts to use a stored refresh token to obtain a fresh ID/access
+// token pair when the current ID token has expired, re-verifies the new ID token, and
+// updates the session in place so the request can proceed without a redirect to the
+// IdP. It returns false (without touching the response) if there's no refresh token to
+// use or the refresh attempt fails, leaving the caller to fall back to re-authorization.
+func refreshSession(c *gin.Context, i InitParams, verifier *oidc.IDTokenVerifier, config *oauth2.Config, serverSession sessions.Session) bool {
+	refreshToken := loadRefreshToken(i, serverSession)
+	if refreshToken == "" {
+		return false
+	}
+
+	ctx := c.Request.Context()
+	newToken, err := config.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+	if err != nil {
+		return false
+	}
+
+	rawIDToken, ok := newToken.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return false
+	}
+
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return false
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return false
+	}
+	claimsJson, err := json.Marshal(claims)
+	if err != nil {
+		return false
+	}
+
+	serverSession.Set("oidcIDToken", rawIDToken)
+	serverSession.Set("oidcClaims", string(claimsJson))
+	if err := saveRefreshToken(i, serverSession, newToken); err != nil {
+		return false
+	}
+	if err := serverSession.Save(); err != nil {
+		return false
+	}
+
+	if i.OnTokenRefresh != nil {
+		i.OnTokenRefresh(ctx, claims)
+	}
+	return true
+}
+
+func redirectToAuthorization(c *gin.Context, i InitParams, config *oauth2.Config, serverSession sessions.Session) {
+	authState := AuthState{
+		State:              RandomString(16),
+		OriginalRequestUrl: c.Request.URL.String(),
+	}
+
+	nonce, err := randomURLSafeString(32)
+	if handleError(c, i, err, "failed to generate nonce") {
+		return
+	}
+	authState.Nonce = nonce
+
+	authCodeOptions := []oauth2.AuthCodeOption{oidc.Nonce(nonce)}
+
+	if usePKCE(i) {
+		codeVerifier, err := randomURLSafeString(32)
+		if handleError(c, i, err, "failed to generate PKCE code verifier") {
+			return
 		}
-		c.Redirect(http.StatusFound, config.AuthCodeURL(state)) //redirect to authorization server
+		authState.CodeVerifier = codeVerifier
+		authCodeOptions = append(authCodeOptions,
+			oauth2.SetAuthURLParam("code_challenge", codeChallengeS256(codeVerifier)),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"))
 	}
 
+	if handleError(c, i, i.StateStore.Save(c, authState), "failed to save auth state") {
+		return
+	}
+
+	serverSession.Set("oidcAuthorized", false)
+	serverSession.Set("oidcIDToken", nil)
+	if handleError(c, i, serverSession.Save(), "failed to save session") {
+		return
+	}
+	c.Redirect(http.StatusFound, config.AuthCodeURL(authState.State, authCodeOptions...)) //redirect to authorization server
 }
 
-func handleError(c *gin.Context, i InitParams, err error, message string) bool {
+// handleError reports err via i.Logger, i.OnError, and i.ErrorHandler, then aborts the
+// request. It returns true when err was non-nil (and thus handled), so call sites can
+// write `if handleError(c, i, err, "...") { return }`.
+func handleError(c *gin.Context, i InitParams, err error, stage string) bool {
 	if err == nil {
 		return false
 	}
-	c.Error(errors.New(message + " [" + err.Error() + "]"))
+	logger(i).Error(stage, "error", err)
+	if i.OnError != nil {
+		i.OnError(c.Request.Context(), stage, err)
+	}
+	c.Error(errors.New(stage + " [" + err.Error() + "]"))
 	i.ErrorHandler(c)
 	c.Abort()
 	return true
@@ -236,29 +391,14 @@ func handleOk(c *gin.Context, i InitParams, ok bool, message string) bool {
 	return handleError(c, i, errors.New("not ok"), message)
 }
 
-//random string
-var src = rand.NewSource(time.Now().UnixNano())
-
-const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-const (
-	letterIdxBits = 6                    // 6 bits to represent a letter index
-	letterIdxMask = 1<<letterIdxBits - 1 // All 1-bits, as many as letterIdxBits
-	letterIdxMax  = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
-)
-
+// RandomString returns a CSPRNG-backed, URL-safe random string built from n bytes of
+// crypto/rand entropy (so its length is longer than n once base64-encoded). It panics if
+// the system's CSPRNG can't be read, which only happens if the OS is unable to provide
+// random bytes at all - not a condition callers can meaningfully recover from.
 func RandomString(n int) string {
-	b := make([]byte, n)
-	for i, cache, remain := n-1, src.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = src.Int63(), letterIdxMax
-		}
-		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
-			b[i] = letterBytes[idx]
-			i--
-		}
-		cache >>= letterIdxBits
-		remain--
+	s, err := randomURLSafeString(n)
+	if err != nil {
+		panic("gin_oidc: failed to read random bytes: " + err.Error())
 	}
-
-	return string(b)
+	return s
 }
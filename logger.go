@@ -0,0 +1,35 @@
+package gin_oidc
+
+import "log"
+
+// Logger is the logging interface gin-oidc writes operational and security-relevant
+// events to. A *slog.Logger (Go 1.21+) satisfies this interface, as does any other
+// leveled logger exposing these four methods.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// stdLogger adapts the standard library's log package to Logger. It's the default used
+// when InitParams.Logger is nil, matching this package's historical behavior of writing
+// failures out rather than staying silent.
+type stdLogger struct{}
+
+func (l stdLogger) Debug(msg string, args ...interface{}) { l.log("DEBUG", msg, args) }
+func (l stdLogger) Info(msg string, args ...interface{})  { l.log("INFO", msg, args) }
+func (l stdLogger) Warn(msg string, args ...interface{})  { l.log("WARN", msg, args) }
+func (l stdLogger) Error(msg string, args ...interface{}) { l.log("ERROR", msg, args) }
+
+func (stdLogger) log(level, msg string, args []interface{}) {
+	log.Println(append([]interface{}{"[gin-oidc]", level, msg}, args...)...)
+}
+
+// logger returns i.Logger, or the default stdLogger if none was configured.
+func logger(i InitParams) Logger {
+	if i.Logger != nil {
+		return i.Logger
+	}
+	return stdLogger{}
+}
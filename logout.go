@@ -0,0 +1,74 @@
+package gin_oidc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// LogoutMode selects how logoutHandler ends a session.
+type LogoutMode int
+
+const (
+	// RPInitiated redirects the browser to the Issuer's end_session_endpoint (OIDC
+	// RP-Initiated Logout 1.0) after clearing the local session, so the IdP's own
+	// session (and any other RPs it's logged into) are also logged out. This is the
+	// default and matches the library's historical behavior.
+	RPInitiated LogoutMode = iota
+	// LocalOnly clears the local session and redirects straight to PostLogoutUrl,
+	// without contacting the Issuer. Use this for providers that don't support
+	// RP-Initiated Logout, or when only this RP's session should end.
+	LocalOnly
+	// BackchannelOnly clears the local session and redirects to PostLogoutUrl, the
+	// same as LocalOnly, but signals that session termination for other RPs is
+	// expected to arrive independently via BackchannelLogoutHandler rather than a
+	// front-channel redirect to the Issuer.
+	BackchannelOnly
+)
+
+// DefaultLogoutParamsBuilder builds the query parameters for the front-channel redirect
+// to the Issuer's end_session_endpoint, per OIDC RP-Initiated Logout 1.0: always sends
+// post_logout_redirect_uri and a random state, and (when present) id_token_hint and
+// client_id. It
+// deliberately doesn't set logout_hint - the spec leaves its value and meaning up to the
+// provider (typically a login identifier, not the sub claim), so guessing one by default
+// risks confusing providers that do support it. Providers that need something different
+// (Auth0's client_id+returnTo instead of post_logout_redirect_uri, or a specific
+// logout_hint, for example) should set InitParams.LogoutParamsBuilder to a custom func
+// instead.
+func DefaultLogoutParamsBuilder(i InitParams, rawIDToken string) url.Values {
+	params := url.Values{
+		"post_logout_redirect_uri": []string{i.PostLogoutUrl.String()},
+		"state":                    []string{RandomString(16)},
+	}
+	if i.ClientId != "" {
+		params.Set("client_id", i.ClientId)
+	}
+	if rawIDToken != "" {
+		params.Set("id_token_hint", rawIDToken)
+	}
+	return params
+}
+
+// unverifiedSubClaim pulls the "sub" claim out of an ID token's payload without
+// checking its signature, for reporting the logged-out user to OnLogout. It's never used for
+// anything security-sensitive - the same rawIDToken has already been through
+// oidc.IDTokenVerifier.Verify by the time a session can be logged out.
+func unverifiedSubClaim(rawIDToken string) string {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Sub string `json:"sub"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	return claims.Sub
+}
@@ -0,0 +1,32 @@
+package gin_oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// randomURLSafeString returns n bytes of crypto/rand entropy, base64url-encoded. It
+// backs both the PKCE code_verifier and the OIDC nonce, both of which need to be
+// unguessable rather than merely unique.
+func randomURLSafeString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// codeChallengeS256 derives the PKCE (RFC 7636) "S256" code_challenge from a
+// code_verifier: base64url(sha256(code_verifier)).
+func codeChallengeS256(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// usePKCE reports whether the Authorization Code flow should use PKCE. It's on by
+// default; set InitParams.UsePKCE to a pointer to false to opt out for confidential
+// clients that don't need it.
+func usePKCE(i InitParams) bool {
+	return i.UsePKCE == nil || *i.UsePKCE
+}
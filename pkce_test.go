@@ -0,0 +1,36 @@
+package gin_oidc
+
+import "testing"
+
+func TestCodeChallengeS256(t *testing.T) {
+	// RFC 7636 Appendix B.
+	const codeVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	const wantChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	if got := codeChallengeS256(codeVerifier); got != wantChallenge {
+		t.Errorf("codeChallengeS256(%q) = %q, want %q", codeVerifier, got, wantChallenge)
+	}
+}
+
+func TestUsePKCE(t *testing.T) {
+	falseValue := false
+	trueValue := true
+
+	tests := []struct {
+		name string
+		i    InitParams
+		want bool
+	}{
+		{name: "unset defaults to true", i: InitParams{}, want: true},
+		{name: "explicit true", i: InitParams{UsePKCE: &trueValue}, want: true},
+		{name: "explicit false opts out", i: InitParams{UsePKCE: &falseValue}, want: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := usePKCE(tc.i); got != tc.want {
+				t.Errorf("usePKCE() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package gin_oidc
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/securecookie"
+)
+
+// ErrStateNotFound is returned by a StateBackend's LoadState (and thus by
+// ServerStateStore.Load) when key isn't known, e.g. because it was never saved, was
+// already consumed by Clear, or expired out of the backend. A caller that ignored this
+// and used the returned zero-value AuthState would have its state/nonce/PKCE checks
+// silently pass against an empty stored value, defeating the CSRF protection they exist
+// for.
+var ErrStateNotFound = errors.New("gin-oidc: auth state not found")
+
+// AuthState is the set of values that must survive the redirect round-trip to the
+// authorization server: the CSRF state, the OIDC nonce, the PKCE code_verifier (empty
+// if PKCE is disabled), and the URL the user was trying to reach before being sent to
+// log in.
+type AuthState struct {
+	State              string
+	Nonce              string
+	CodeVerifier       string
+	OriginalRequestUrl string
+}
+
+// StateStore persists AuthState across the Authorization Code redirect, independently
+// of the application's session backend - so a cookie-based session doesn't have to grow
+// (or be re-signed) just to survive a trip to the IdP and back. Save is called right
+// before redirecting to the authorization server; Load recovers what was saved when the
+// callback comes in, and Clear removes it once the flow completes, successfully or not.
+type StateStore interface {
+	Save(c *gin.Context, authState AuthState) error
+	Load(c *gin.Context) (AuthState, error)
+	Clear(c *gin.Context)
+}
+
+const stateCookieName = "_oidc_state"
+
+// CookieStateStore is the default StateStore. It keeps AuthState in a single
+// signed+encrypted cookie, mirroring the CookieHandler pattern used by zitadel/oidc:
+// nothing is stored server-side, so it works unmodified across any number of instances
+// behind a load balancer, as long as they share hashKey/blockKey.
+type CookieStateStore struct {
+	codec *securecookie.SecureCookie
+}
+
+// NewCookieStateStore builds a CookieStateStore. hashKey and blockKey are passed
+// straight to gorilla/securecookie - see its docs for the expected key sizes (32 or 64
+// bytes for hashKey; 16, 24 or 32 bytes for blockKey to additionally enable encryption).
+func NewCookieStateStore(hashKey, blockKey []byte) *CookieStateStore {
+	return &CookieStateStore{codec: securecookie.New(hashKey, blockKey)}
+}
+
+func (s *CookieStateStore) Save(c *gin.Context, authState AuthState) error {
+	encoded, err := s.codec.Encode(stateCookieName, authState)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     stateCookieName,
+		Value:    encoded,
+		Path:     "/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func (s *CookieStateStore) Load(c *gin.Context) (AuthState, error) {
+	var authState AuthState
+	cookie, err := c.Request.Cookie(stateCookieName)
+	if err != nil {
+		return authState, err
+	}
+	err = s.codec.Decode(stateCookieName, cookie.Value, &authState)
+	return authState, err
+}
+
+func (s *CookieStateStore) Clear(c *gin.Context) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     stateCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+// StateBackend is the server-side half of a ServerStateStore: a place to keep AuthState
+// keyed by an opaque id. Implement this against Redis (e.g. github.com/boj/redistore),
+// a database, or anything else shared across instances.
+type StateBackend interface {
+	SaveState(key string, authState AuthState) error
+	LoadState(key string) (AuthState, error)
+	DeleteState(key string)
+}
+
+// MemoryStateBackend is a process-local StateBackend. Fine for a single instance or for
+// trying things out; for a multi-instance deployment, implement StateBackend against a
+// shared store instead.
+type MemoryStateBackend struct {
+	mu     sync.Mutex
+	states map[string]AuthState
+}
+
+func NewMemoryStateBackend() *MemoryStateBackend {
+	return &MemoryStateBackend{states: make(map[string]AuthState)}
+}
+
+func (b *MemoryStateBackend) SaveState(key string, authState AuthState) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.states[key] = authState
+	return nil
+}
+
+func (b *MemoryStateBackend) LoadState(key string) (AuthState, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	authState, ok := b.states[key]
+	if !ok {
+		return AuthState{}, ErrStateNotFound
+	}
+	return authState, nil
+}
+
+func (b *MemoryStateBackend) DeleteState(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.states, key)
+}
+
+// ServerStateStore is a StateStore that keeps AuthState server-side in a StateBackend,
+// with only an opaque, randomly generated key carried in a cookie. Prefer this over
+// CookieStateStore if you don't want auth state values (particularly the PKCE
+// code_verifier) round-tripping through the browser, or want it backed by the same
+// store your sessions already use.
+type ServerStateStore struct {
+	backend StateBackend
+}
+
+func NewServerStateStore(backend StateBackend) *ServerStateStore {
+	return &ServerStateStore{backend: backend}
+}
+
+func (s *ServerStateStore) Save(c *gin.Context, authState AuthState) error {
+	key := RandomString(32)
+	if err := s.backend.SaveState(key, authState); err != nil {
+		return err
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     stateCookieName,
+		Value:    key,
+		Path:     "/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func (s *ServerStateStore) Load(c *gin.Context) (AuthState, error) {
+	cookie, err := c.Request.Cookie(stateCookieName)
+	if err != nil {
+		return AuthState{}, err
+	}
+	return s.backend.LoadState(cookie.Value)
+}
+
+func (s *ServerStateStore) Clear(c *gin.Context) {
+	if cookie, err := c.Request.Cookie(stateCookieName); err == nil {
+		s.backend.DeleteState(cookie.Value)
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     stateCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
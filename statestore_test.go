@@ -0,0 +1,82 @@
+package gin_oidc
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMemoryStateBackendLoadStateUnknownKey(t *testing.T) {
+	backend := NewMemoryStateBackend()
+
+	_, err := backend.LoadState("unknown")
+	if !errors.Is(err, ErrStateNotFound) {
+		t.Fatalf("LoadState(unknown key) error = %v, want ErrStateNotFound", err)
+	}
+}
+
+func TestMemoryStateBackendSaveAndLoad(t *testing.T) {
+	backend := NewMemoryStateBackend()
+	want := AuthState{State: "s", Nonce: "n", CodeVerifier: "v", OriginalRequestUrl: "/"}
+
+	if err := backend.SaveState("key", want); err != nil {
+		t.Fatalf("SaveState: %v", err)
+	}
+	got, err := backend.LoadState("key")
+	if err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	if got != want {
+		t.Fatalf("LoadState() = %+v, want %+v", got, want)
+	}
+
+	backend.DeleteState("key")
+	if _, err := backend.LoadState("key"); !errors.Is(err, ErrStateNotFound) {
+		t.Fatalf("LoadState() after DeleteState error = %v, want ErrStateNotFound", err)
+	}
+}
+
+func TestServerStateStoreLoadWithoutCookieIsNotFound(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := NewServerStateStore(NewMemoryStateBackend())
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/callback", nil)
+
+	if _, err := store.Load(c); err == nil {
+		t.Fatal("Load() with no state cookie: want error, got nil")
+	}
+}
+
+func TestCookieStateStoreSaveAndLoad(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := NewCookieStateStore([]byte("0123456789abcdef0123456789abcdef"), []byte("0123456789abcdef"))
+	want := AuthState{State: "s", Nonce: "n", CodeVerifier: "v", OriginalRequestUrl: "/"}
+
+	saveW := httptest.NewRecorder()
+	saveC, _ := gin.CreateTestContext(saveW)
+	saveC.Request = httptest.NewRequest(http.MethodGet, "/login", nil)
+	if err := store.Save(saveC, want); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	loadW := httptest.NewRecorder()
+	loadC, _ := gin.CreateTestContext(loadW)
+	loadReq := httptest.NewRequest(http.MethodGet, "/callback", nil)
+	for _, cookie := range saveW.Result().Cookies() {
+		loadReq.AddCookie(cookie)
+	}
+	loadC.Request = loadReq
+
+	got, err := store.Load(loadC)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if got != want {
+		t.Fatalf("Load() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,90 @@
+package gin_oidc
+
+import (
+	"sync"
+
+	sessions "github.com/gin-contrib/sessions"
+	"golang.org/x/oauth2"
+)
+
+// TokenStore persists OAuth2 tokens (most importantly the refresh token) server-side,
+// keyed by an opaque id that OidcMiddleware generates and keeps in the session under
+// "oidcTokenKey". Use this instead of the session's default behavior when your session
+// backend is cookie-based, since a refresh token (and the access token that comes with
+// it) can easily push a signed cookie over the browser's size limit.
+type TokenStore interface {
+	SaveToken(key string, token *oauth2.Token) error
+	LoadToken(key string) (*oauth2.Token, error)
+	DeleteToken(key string) error
+}
+
+// MemoryTokenStore is a process-local TokenStore. It's fine for a single instance or for
+// trying things out, but tokens won't survive a restart and won't be shared across
+// instances behind a load balancer - for that, implement TokenStore against Redis, a
+// database, etc.
+type MemoryTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]*oauth2.Token
+}
+
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{tokens: make(map[string]*oauth2.Token)}
+}
+
+func (s *MemoryTokenStore) SaveToken(key string, token *oauth2.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[key] = token
+	return nil
+}
+
+func (s *MemoryTokenStore) LoadToken(key string) (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokens[key], nil
+}
+
+func (s *MemoryTokenStore) DeleteToken(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, key)
+	return nil
+}
+
+// saveRefreshToken persists token.RefreshToken so a later request can use it to obtain a
+// fresh ID token without a redirect to the IdP. When i.TokenStore is set the whole token
+// is stored server-side, keyed by an id kept in the session; otherwise the refresh token
+// is kept directly in the session, same as the rest of this package's session state.
+func saveRefreshToken(i InitParams, serverSession sessions.Session, token *oauth2.Token) error {
+	if token.RefreshToken == "" {
+		return nil
+	}
+	if i.TokenStore == nil {
+		serverSession.Set("oidcRefreshToken", token.RefreshToken)
+		return nil
+	}
+	key, ok := serverSession.Get("oidcTokenKey").(string)
+	if !ok || key == "" {
+		key = RandomString(32)
+		serverSession.Set("oidcTokenKey", key)
+	}
+	return i.TokenStore.SaveToken(key, token)
+}
+
+// loadRefreshToken returns the refresh token saved by saveRefreshToken, or "" if there
+// isn't one.
+func loadRefreshToken(i InitParams, serverSession sessions.Session) string {
+	if i.TokenStore == nil {
+		refreshToken, _ := serverSession.Get("oidcRefreshToken").(string)
+		return refreshToken
+	}
+	key, ok := serverSession.Get("oidcTokenKey").(string)
+	if !ok || key == "" {
+		return ""
+	}
+	token, err := i.TokenStore.LoadToken(key)
+	if err != nil || token == nil {
+		return ""
+	}
+	return token.RefreshToken
+}